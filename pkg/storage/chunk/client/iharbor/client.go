@@ -0,0 +1,561 @@
+package iharbor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+)
+
+// IHarborClient is a thin HTTP client for the iharbor object storage REST
+// API (PUT/GET/DELETE under /api/v1/obj/{bucket}/{key}, plus the metadata,
+// listing, copy and multipart endpoints alongside it). IHarborObjectClient
+// is built on top of it to satisfy chunk.ObjectClient; IHarborClient itself
+// knows nothing about chunks, retries or compaction.
+type IHarborClient struct {
+	baseURL     string
+	token       string
+	httpClient  *http.Client
+	tokenSource oauth2.TokenSource
+}
+
+// NewIHarborClient dials endpoint (https when secure is true), authenticating
+// every request with a static token unless resolved options override it with
+// a token source. Use WithHTTPClient/WithTransport/WithTLSConfig (see
+// options.go) to customize the transport.
+func NewIHarborClient(secure bool, endpoint, token string, opts ...Option) (*IHarborClient, error) {
+	if endpoint == "" {
+		return nil, errors.New("iharbor endpoint must not be empty")
+	}
+
+	resolved := resolveClientOptions(opts...)
+	httpClient := resolved.httpClient
+	if httpClient == nil {
+		httpClient = &http.Client{}
+		switch {
+		case resolved.transport != nil:
+			httpClient.Transport = resolved.transport
+		case resolved.tlsConfig != nil:
+			httpClient.Transport = &http.Transport{TLSClientConfig: resolved.tlsConfig}
+		}
+	}
+
+	scheme := "http"
+	if secure {
+		scheme = "https"
+	}
+
+	return &IHarborClient{
+		baseURL:     scheme + "://" + endpoint,
+		token:       token,
+		httpClient:  httpClient,
+		tokenSource: resolved.tokenSource,
+	}, nil
+}
+
+// objectPath builds the REST path for an object, keeping key's internal "/"
+// separators intact (they model iharbor's directory structure) rather than
+// percent-encoding them away.
+func objectPath(bucket, key string) string {
+	return path.Join("/api/v1/obj", bucket, key)
+}
+
+func (c *IHarborClient) authHeader() (string, error) {
+	if c.tokenSource != nil {
+		tok, err := c.tokenSource.Token()
+		if err != nil {
+			return "", errors.Wrap(err, "refresh iharbor oauth token")
+		}
+		return "Bearer " + tok.AccessToken, nil
+	}
+	return "Token " + c.token, nil
+}
+
+func (c *IHarborClient) newRequest(ctx context.Context, method, rawPath string, query url.Values, body io.Reader) (*http.Request, error) {
+	u := c.baseURL + rawPath
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, errors.Wrap(err, "build iharbor request")
+	}
+	auth, err := c.authHeader()
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", auth)
+	return req, nil
+}
+
+// iharborErrorBody is the JSON error envelope iharbor returns on non-2xx
+// responses.
+type iharborErrorBody struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// httpStatusError is returned for any non-2xx response. Its fields drive the
+// IsObjNotFoundErr/IsNoParentPathErr/IsNotImplementedErr/IsRetryableErr
+// classification methods below.
+type httpStatusError struct {
+	statusCode int
+	code       string
+	message    string
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("iharbor request failed: status=%d code=%q message=%q", e.statusCode, e.code, e.message)
+}
+
+// checkResponse returns a *httpStatusError, built from up to 64KiB of
+// resp.Body, if the response was not 2xx. A 2xx body is left unread for the
+// caller.
+func checkResponse(resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<16))
+	var parsed iharborErrorBody
+	_ = json.Unmarshal(body, &parsed)
+
+	return &httpStatusError{
+		statusCode: resp.StatusCode,
+		code:       parsed.Code,
+		message:    parsed.Message,
+	}
+}
+
+// PutObject uploads the contents of r as key in bucket via a single PUT
+// request. Callers that need retries wrap the call (see
+// IHarborObjectClient.withRetry); if ctx carries a key from
+// withIdempotencyKey, it is sent as idempotencyKeyHeader so a retried
+// attempt is deduplicated against one that iharbor already accepted but
+// whose response never reached us.
+func (c *IHarborClient) PutObject(ctx context.Context, bucket, key string, r io.Reader) error {
+	req, err := c.newRequest(ctx, http.MethodPut, objectPath(bucket, key), nil, r)
+	if err != nil {
+		return err
+	}
+	if idemKey, ok := idempotencyKeyFromContext(ctx); ok {
+		req.Header.Set(idempotencyKeyHeader, idemKey)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "do PUT request")
+	}
+	defer resp.Body.Close()
+	return checkResponse(resp)
+}
+
+// GetObject returns a reader over [off, off+length) of key in bucket. A
+// negative length requests the remainder of the object from off.
+func (c *IHarborClient) GetObject(ctx context.Context, bucket, key string, off, length int64) (io.ReadCloser, int64, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, objectPath(bucket, key), nil, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if off > 0 || length >= 0 {
+		if length < 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", off))
+		} else {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+length-1))
+		}
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "do GET request")
+	}
+	if err := checkResponse(resp); err != nil {
+		resp.Body.Close()
+		return nil, 0, err
+	}
+
+	return resp.Body, resp.ContentLength, nil
+}
+
+// objectMeta is the "obj" payload returned by GetObjectMeta.
+type objectMeta struct {
+	Size      int64 `json:"size"`
+	FileOrDir bool  `json:"fod"`
+}
+
+// ObjectMetaResult wraps the metadata iharbor reports for an object or
+// directory entry.
+type ObjectMetaResult struct {
+	Obj objectMeta `json:"obj"`
+}
+
+// GetObjectMeta fetches size/type metadata for key in bucket without
+// downloading its contents.
+func (c *IHarborClient) GetObjectMeta(ctx context.Context, bucket, key string) (*ObjectMetaResult, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, objectPath(bucket, key), url.Values{"info": {"true"}}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "do GET metadata request")
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp); err != nil {
+		return nil, err
+	}
+
+	var meta ObjectMetaResult
+	if err := json.NewDecoder(resp.Body).Decode(&meta); err != nil {
+		return nil, errors.Wrap(err, "decode object metadata")
+	}
+	return &meta, nil
+}
+
+// bucketEntry is one entry in a ListBucketObjects page: either a leaf object
+// or a common "directory" prefix, distinguished by IsObject.
+type bucketEntry struct {
+	Key          string `json:"key"`
+	IsObject     bool   `json:"is_obj"`
+	LastModified string `json:"last_modified"`
+}
+
+// ListBucketObjectsResult is one page of a bucket listing.
+type ListBucketObjectsResult struct {
+	Contents              []bucketEntry `json:"contents"`
+	IsTruncated           bool          `json:"is_truncated"`
+	NextContinuationToken string        `json:"next_continuation_token"`
+}
+
+// ListBucketObjects lists up to limit entries (limit < 0 means iharbor's
+// default page size) directly under prefix, split on delimiter, continuing
+// from a previous page's NextContinuationToken when continuationToken is
+// non-empty.
+func (c *IHarborClient) ListBucketObjects(ctx context.Context, bucket, prefix, delimiter, continuationToken string, limit int) (*ListBucketObjectsResult, error) {
+	query := url.Values{"prefix": {prefix}}
+	if delimiter != "" {
+		query.Set("delimiter", delimiter)
+	}
+	if continuationToken != "" {
+		query.Set("continuation-token", continuationToken)
+	}
+	if limit >= 0 {
+		query.Set("limit", fmt.Sprintf("%d", limit))
+	}
+
+	req, err := c.newRequest(ctx, http.MethodGet, path.Join("/api/v1/obj", bucket)+"/", query, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "do list request")
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp); err != nil {
+		return nil, err
+	}
+
+	var result ListBucketObjectsResult
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, errors.Wrap(err, "decode list response")
+	}
+	return &result, nil
+}
+
+// DeleteObject removes key from bucket.
+func (c *IHarborClient) DeleteObject(ctx context.Context, bucket, key string) error {
+	req, err := c.newRequest(ctx, http.MethodDelete, objectPath(bucket, key), nil, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "do DELETE request")
+	}
+	defer resp.Body.Close()
+	return checkResponse(resp)
+}
+
+// IsObjNotFoundErr returns true if err means the requested object does not
+// exist.
+func (c *IHarborClient) IsObjNotFoundErr(err error) bool {
+	statusErr, ok := err.(*httpStatusError)
+	if !ok {
+		return false
+	}
+	return statusErr.statusCode == http.StatusNotFound || statusErr.code == "NoSuchKey"
+}
+
+// IsNoParentPathErr returns true if err means a List was issued against a
+// prefix whose parent directory does not exist, which iharbor treats as an
+// error rather than an empty listing.
+func (c *IHarborClient) IsNoParentPathErr(err error) bool {
+	statusErr, ok := err.(*httpStatusError)
+	return ok && statusErr.code == "NoParentPath"
+}
+
+// CopyObject asks iharbor to copy srcKey in srcBucket to dstKey in dstBucket
+// server-side. It returns an error satisfying IsNotImplementedErr if the
+// target iharbor deployment has no native copy endpoint, so callers can fall
+// back to a streaming copy (see CopyObjectAcrossBuckets in copy.go).
+func (c *IHarborClient) CopyObject(ctx context.Context, srcBucket, srcKey, dstBucket, dstKey string) error {
+	query := url.Values{
+		"copy_source": {path.Join("/", srcBucket, srcKey)},
+	}
+	req, err := c.newRequest(ctx, http.MethodPut, objectPath(dstBucket, dstKey), query, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "do copy object request")
+	}
+	defer resp.Body.Close()
+	return checkResponse(resp)
+}
+
+// IsNotImplementedErr returns true if err means the iharbor deployment does
+// not support the requested operation (e.g. server-side copy across
+// storage backends), as opposed to a request-specific failure.
+func (c *IHarborClient) IsNotImplementedErr(err error) bool {
+	statusErr, ok := err.(*httpStatusError)
+	if !ok {
+		return false
+	}
+	return statusErr.statusCode == http.StatusNotImplemented || statusErr.code == "NotImplemented"
+}
+
+// IsRetryableErr returns true if err is a transient failure worth retrying:
+// a 5xx or 429 response from iharbor, or a network-level timeout/reset
+// talking to it. A non-transient 4xx (auth, not found, bad request) is not
+// retryable, since retrying it would just fail the same way again.
+func (c *IHarborClient) IsRetryableErr(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return true
+	}
+	if urlErr, ok := err.(*url.Error); ok {
+		if urlErr.Timeout() {
+			return true
+		}
+		msg := urlErr.Error()
+		if strings.Contains(msg, "connection reset") || strings.Contains(msg, "EOF") {
+			return true
+		}
+	}
+
+	statusErr, ok := err.(*httpStatusError)
+	if !ok {
+		return false
+	}
+	return statusErr.statusCode == http.StatusTooManyRequests || statusErr.statusCode >= 500
+}
+
+// TryToGetSize returns the size of r by seeking to its end and back, or an
+// error if r does not support seeking (e.g. a pipe). Upload uses it to pick
+// between a single PutObject call, for objects of up to 128MiB, and
+// UploadStream, for larger objects and for readers whose size cannot be
+// found.
+func TryToGetSize(r io.ReadSeeker) (int64, error) {
+	cur, err := r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, errors.Wrap(err, "seek to current position")
+	}
+	end, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, errors.Wrap(err, "seek to end")
+	}
+	if _, err := r.Seek(cur, io.SeekStart); err != nil {
+		return 0, errors.Wrap(err, "seek back to original position")
+	}
+	return end - cur, nil
+}
+
+const multipartUploadPartSize = 1024 * 1024 * 64
+
+// InitiateMultipartUpload starts a multipart upload session for key in
+// bucket and returns its upload ID. Used both by MultipartUploadObject,
+// for known-size uploads, and by UploadStream (stream.go), which does not
+// know the size ahead of time.
+func (c *IHarborClient) InitiateMultipartUpload(ctx context.Context, bucket, key string) (string, error) {
+	req, err := c.newRequest(ctx, http.MethodPost, objectPath(bucket, key), url.Values{"uploads": {""}}, nil)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", errors.Wrap(err, "do initiate multipart upload request")
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp); err != nil {
+		return "", err
+	}
+
+	var result struct {
+		UploadID string `json:"upload_id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", errors.Wrap(err, "decode initiate multipart upload response")
+	}
+	return result.UploadID, nil
+}
+
+// UploadPart uploads partNum of the session uploadID and returns its ETag.
+// If ctx carries a key from withIdempotencyKey, it is sent as
+// idempotencyKeyHeader so a retried part is deduplicated server-side.
+func (c *IHarborClient) UploadPart(ctx context.Context, bucket, key, uploadID string, partNum int, data []byte) (string, error) {
+	query := url.Values{"uploadId": {uploadID}, "partNumber": {fmt.Sprintf("%d", partNum)}}
+	req, err := c.newRequest(ctx, http.MethodPut, objectPath(bucket, key), query, bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	if idemKey, ok := idempotencyKeyFromContext(ctx); ok {
+		req.Header.Set(idempotencyKeyHeader, idemKey)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", errors.Wrap(err, "do upload part request")
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp); err != nil {
+		return "", err
+	}
+	return resp.Header.Get("ETag"), nil
+}
+
+// CompleteMultipartUpload finalizes uploadID, assembling parts in order.
+func (c *IHarborClient) CompleteMultipartUpload(ctx context.Context, bucket, key, uploadID string, parts []uploadPart) error {
+	body, err := json.Marshal(parts)
+	if err != nil {
+		return errors.Wrap(err, "encode complete multipart upload body")
+	}
+
+	req, err := c.newRequest(ctx, http.MethodPost, objectPath(bucket, key), url.Values{"uploadId": {uploadID}}, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "do complete multipart upload request")
+	}
+	defer resp.Body.Close()
+	return checkResponse(resp)
+}
+
+// AbortMultipartUpload releases any parts already uploaded for uploadID.
+func (c *IHarborClient) AbortMultipartUpload(ctx context.Context, bucket, key, uploadID string) error {
+	req, err := c.newRequest(ctx, http.MethodDelete, objectPath(bucket, key), url.Values{"uploadId": {uploadID}}, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "do abort multipart upload request")
+	}
+	defer resp.Body.Close()
+	return checkResponse(resp)
+}
+
+// MultipartUploadObject uploads the full, known-size contents of r as key in
+// bucket, splitting it into multipartUploadPartSize parts and uploading up
+// to concurrency of them at a time. concurrency <= 0 is treated as 1.
+func (c *IHarborClient) MultipartUploadObject(ctx context.Context, bucket, key string, r io.ReadSeeker, concurrency int) error {
+	uploadID, err := c.InitiateMultipartUpload(ctx, bucket, key)
+	if err != nil {
+		return errors.Wrap(err, "initiate multipart upload")
+	}
+
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	semaphore := make(chan struct{}, concurrency)
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		parts    []uploadPart
+		firstErr error
+	)
+
+	recordErr := func(err error) {
+		mu.Lock()
+		if firstErr == nil {
+			firstErr = err
+		}
+		mu.Unlock()
+	}
+
+	partNum := 0
+	for {
+		if err := ctx.Err(); err != nil {
+			recordErr(err)
+			break
+		}
+
+		buf := make([]byte, multipartUploadPartSize)
+		n, readErr := io.ReadFull(r, buf)
+		if n == 0 && readErr != nil {
+			break
+		}
+		buf = buf[:n]
+		partNum++
+		num := partNum
+
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+
+			etag, err := c.UploadPart(ctx, bucket, key, uploadID, num, buf)
+			if err != nil {
+				recordErr(errors.Wrapf(err, "upload part %d of [%s]", num, key))
+				return
+			}
+			mu.Lock()
+			parts = append(parts, uploadPart{number: num, etag: etag})
+			mu.Unlock()
+		}()
+
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil {
+			recordErr(errors.Wrap(readErr, "read part for multipart upload"))
+			break
+		}
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		if abortErr := c.AbortMultipartUpload(ctx, bucket, key, uploadID); abortErr != nil {
+			return errors.Wrapf(firstErr, "multipart upload failed and abort also failed: %v", abortErr)
+		}
+		return errors.Wrap(firstErr, "multipart upload")
+	}
+
+	return c.CompleteMultipartUpload(ctx, bucket, key, uploadID, completeParts(parts))
+}
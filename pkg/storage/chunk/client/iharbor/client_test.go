@@ -0,0 +1,185 @@
+package iharbor
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+)
+
+// newTestObjectClient points an IHarborObjectClient at srv without going
+// through NewIHarborObjectClient's config validation, which tests here have
+// no use for.
+func newTestObjectClient(t *testing.T, srv *httptest.Server) *IHarborObjectClient {
+	t.Helper()
+
+	endpoint := strings.TrimPrefix(srv.URL, "http://")
+	client, err := NewIHarborClient(false, endpoint, "test-token", WithHTTPClient(srv.Client()))
+	if err != nil {
+		t.Fatalf("NewIHarborClient: %v", err)
+	}
+
+	return &IHarborObjectClient{
+		client: client,
+		name:   "test-bucket",
+		config: IHarborConfig{BucketName: "test-bucket"},
+		logger: log.NewNopLogger(),
+	}
+}
+
+// warmUpConnection issues a throwaway request over srv's client so that the
+// keep-alive connection's read/write-loop goroutines, on both ends, already
+// exist by the time a test captures its goroutine baseline. Without this,
+// those goroutines get created by the test's first real request and so look
+// indistinguishable from a leak once that request's context is cancelled.
+func warmUpConnection(t *testing.T, srv *httptest.Server) {
+	t.Helper()
+
+	resp, err := srv.Client().Get(srv.URL)
+	if err != nil {
+		t.Fatalf("warm up connection: %v", err)
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+}
+
+// waitForGoroutineBaseline polls until runtime.NumGoroutine() settles back
+// down to at most baseline+margin, failing the test if it never does. It
+// guards against the multipart worker pool in UploadStream or any HTTP
+// transport goroutine surviving past a cancelled call.
+func waitForGoroutineBaseline(t *testing.T, baseline, margin int) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if n := runtime.NumGoroutine(); n <= baseline+margin {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("goroutine count did not settle: got %d, want <= %d", runtime.NumGoroutine(), baseline+margin)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestUploadStream_ContextCancellationStopsWorkers cancels the context
+// mid-upload, while one part's HTTP request is blocked in flight, and
+// asserts that UploadStream returns promptly and its worker goroutines do
+// not leak past the call.
+func TestUploadStream_ContextCancellationStopsWorkers(t *testing.T) {
+	partRequested := make(chan struct{}, 1)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/obj/test-bucket/stream-key", func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPost && r.URL.Query().Has("uploads"):
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(map[string]string{"upload_id": "test-upload-id"})
+		case r.Method == http.MethodPut && r.URL.Query().Has("uploadId"):
+			select {
+			case partRequested <- struct{}{}:
+			default:
+			}
+			// Simulate a stalled backend. Prefer r.Context().Done(), which
+			// fires once the client gives up on us, but cap the wait so the
+			// handler (and so httptest.Server.Close in the test cleanup)
+			// can't hang if connection-close propagation is slow.
+			select {
+			case <-r.Context().Done():
+			case <-time.After(time.Second):
+			}
+		default:
+			w.WriteHeader(http.StatusNotImplemented)
+		}
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	b := newTestObjectClient(t, srv)
+	warmUpConnection(t, srv)
+
+	baseline := runtime.NumGoroutine()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := strings.NewReader(strings.Repeat("x", 8))
+
+	done := make(chan error, 1)
+	go func() {
+		done <- b.UploadStream(ctx, "stream-key", r, 4)
+	}()
+
+	select {
+	case <-partRequested:
+	case <-time.After(2 * time.Second):
+		t.Fatal("server never received the part upload request")
+	}
+	cancel()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("expected UploadStream to fail after context cancellation")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("UploadStream did not return after its context was cancelled")
+	}
+
+	waitForGoroutineBaseline(t, baseline, 2)
+}
+
+// TestList_ContextCancellationStopsPaging cancels the context after the
+// first page of a List call and asserts it returns promptly instead of
+// fetching every remaining page, and that no goroutines are left behind.
+func TestList_ContextCancellationStopsPaging(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/obj/test-bucket/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Query().Get("continuation-token") == "" {
+			_ = json.NewEncoder(w).Encode(ListBucketObjectsResult{
+				Contents:              []bucketEntry{{Key: "a", IsObject: true}},
+				IsTruncated:           true,
+				NextContinuationToken: "page-2",
+			})
+			return
+		}
+		// A later page blocks until the caller's context is cancelled,
+		// which the client passes on to this request; cap the wait so this
+		// handler can't hang the test if that cancellation never arrives.
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	b := newTestObjectClient(t, srv)
+	warmUpConnection(t, srv)
+
+	baseline := runtime.NumGoroutine()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Cancel shortly after the first page is handled. Depending on timing the
+	// cancellation is seen by the loop's ctx.Err check or, usually, by the
+	// second page request already blocked in the handler.
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+
+	_, _, err := b.List(ctx, "", "")
+	if err == nil {
+		t.Fatal("expected List to fail after context cancellation")
+	}
+
+	waitForGoroutineBaseline(t, baseline, 2)
+}
@@ -0,0 +1,192 @@
+package iharbor
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/grafana/loki/pkg/storage/chunk/client"
+)
+
+var (
+	compactionObjectsMerged = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "loki_iharbor_compaction_objects_merged_total",
+		Help: "Total number of small iharbor chunk objects rolled up into a compacted aggregate object.",
+	})
+	compactionFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "loki_iharbor_compaction_failures_total",
+		Help: "Total number of compaction groups that failed to merge.",
+	})
+)
+
+// startCompaction launches the background compactor goroutine. It must only
+// be called once, from NewIHarborObjectClient.
+func (b *IHarborObjectClient) startCompaction() {
+	b.compactionDone = make(chan struct{})
+	b.compactionWG.Add(1)
+
+	go func() {
+		defer b.compactionWG.Done()
+		b.runCompactionLoop()
+	}()
+}
+
+func (b *IHarborObjectClient) runCompactionLoop() {
+	ticker := time.NewTicker(b.config.CompactionInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.compactionDone:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), b.config.CompactionInterval)
+			if err := b.compactOnce(ctx, b.config.CompactionPrefix); err != nil {
+				level.Error(b.logger).Log("msg", "iharbor compaction run failed", "err", err)
+			}
+			cancel()
+		}
+	}
+}
+
+// compactOnce lists objects under prefix, groups them by tenant/day and
+// merges any group with at least CompactionMinObjects small chunk objects
+// into a single larger "compacted-*" aggregate object, verifying its size
+// once uploaded. The original objects are left in place: the boltdb-shipper
+// index stores each chunk's original key as its storage reference, and
+// nothing yet teaches the read path to resolve that key to an offset inside
+// a compacted aggregate, so deleting the originals here would make those
+// chunks permanently unreadable.
+func (b *IHarborObjectClient) compactOnce(ctx context.Context, prefix string) error {
+	objects, _, err := b.List(ctx, prefix, "")
+	if err != nil {
+		return errors.Wrap(err, "list objects for compaction")
+	}
+
+	for groupKey, group := range groupByTenantDay(objects) {
+		if len(group) < b.config.CompactionMinObjects {
+			continue
+		}
+		if err := b.compactGroup(ctx, groupKey, group); err != nil {
+			compactionFailures.Inc()
+			level.Error(b.logger).Log("msg", "iharbor compaction: failed to compact group", "group", groupKey, "err", err)
+		}
+	}
+
+	return nil
+}
+
+// compactedKeyPrefix marks the third "/"-delimited segment of an aggregate
+// object already produced by compactGroup, so a later run can recognize and
+// skip it instead of re-selecting its own output as a compaction candidate.
+const compactedKeyPrefix = "compacted-"
+
+// isCompactedObject reports whether key names an aggregate object already
+// produced by compactGroup. Its first two segments are still the tenant/day
+// group groupByTenantDay buckets on (mergedKey is built as
+// "<group>/compacted-<sourceKey>"), so without this check a group that was
+// already compacted would be re-selected and re-merged forever.
+func isCompactedObject(key string) bool {
+	parts := strings.SplitN(key, "/", 3)
+	return len(parts) == 3 && strings.HasPrefix(parts[2], compactedKeyPrefix)
+}
+
+// groupByTenantDay buckets objects by the first two "/"-delimited path
+// segments, which for iharbor chunk objects are the tenant ID and the day
+// the chunk was written on. Objects already produced by a prior compaction
+// run are excluded; see isCompactedObject.
+func groupByTenantDay(objects []client.StorageObject) map[string][]client.StorageObject {
+	groups := make(map[string][]client.StorageObject)
+	for _, o := range objects {
+		if isCompactedObject(o.Key) {
+			continue
+		}
+		parts := strings.SplitN(o.Key, "/", 3)
+		if len(parts) < 2 {
+			continue
+		}
+		key := parts[0] + "/" + parts[1]
+		groups[key] = append(groups[key], o)
+	}
+	return groups
+}
+
+func (b *IHarborObjectClient) compactGroup(ctx context.Context, groupKey string, group []client.StorageObject) error {
+	sort.Slice(group, func(i, j int) bool { return group[i].ModifiedAt.Before(group[j].ModifiedAt) })
+
+	var (
+		merged      bytes.Buffer
+		mergedKeys  []string
+		totalSize   int64
+		lengthBytes [8]byte
+	)
+
+	for _, o := range group {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if totalSize >= b.config.CompactionMaxSize {
+			break
+		}
+
+		r, _, err := b.GetObject(ctx, o.Key)
+		if err != nil {
+			return errors.Wrapf(err, "download object [%s] for compaction", o.Key)
+		}
+		data, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			return errors.Wrapf(err, "read object [%s] for compaction", o.Key)
+		}
+		// Stop before this object, with its length frame, would push the
+		// aggregate past CompactionMaxSize.
+		if totalSize+int64(len(lengthBytes)+len(data)) > b.config.CompactionMaxSize {
+			break
+		}
+
+		// Frame each source object's chunk bytes with its length. No code
+		// path reads a compacted aggregate back yet (see compactOnce), so
+		// this framing only keeps the option of a future decoder open; it
+		// is not itself "Loki's chunk encoding".
+		binary.BigEndian.PutUint64(lengthBytes[:], uint64(len(data)))
+		merged.Write(lengthBytes[:])
+		merged.Write(data)
+
+		mergedKeys = append(mergedKeys, o.Key)
+		totalSize += int64(len(lengthBytes) + len(data))
+	}
+
+	if len(mergedKeys) < 2 {
+		return nil
+	}
+
+	mergedKey := groupKey + "/" + compactedKeyPrefix + mergedKeys[0]
+	mergedSize := int64(merged.Len())
+	if err := b.Upload(ctx, mergedKey, bytes.NewReader(merged.Bytes())); err != nil {
+		return errors.Wrapf(err, "upload merged object [%s]", mergedKey)
+	}
+
+	meta, err := b.client.GetObjectMeta(ctx, b.name, mergedKey)
+	if err != nil {
+		return errors.Wrapf(err, "verify merged object [%s]", mergedKey)
+	}
+	if int64(meta.Obj.Size) != mergedSize {
+		return errors.Errorf("merged object [%s] failed content-length verification: got %d, want %d", mergedKey, meta.Obj.Size, mergedSize)
+	}
+
+	// The source objects are intentionally not deleted: see the comment on
+	// compactOnce. mergedKey is stored as a side aggregate only.
+
+	compactionObjectsMerged.Add(float64(len(mergedKeys)))
+
+	return nil
+}
@@ -0,0 +1,77 @@
+package iharbor
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+)
+
+// multipartThreshold is the size above which a fallback copy streams through
+// uploadStreamToBucket instead of a single putObjectData, matching the
+// threshold already used by Upload.
+const multipartThreshold = 1024 * 1024 * 128 // 128MiB
+
+// CopyObject copies srcKey to dstKey within the client's bucket, using
+// iharbor's native server-side copy endpoint when available and falling
+// back to a streaming GetObject->Upload round-trip otherwise.
+func (b *IHarborObjectClient) CopyObject(ctx context.Context, srcKey, dstKey string) error {
+	return b.CopyObjectAcrossBuckets(ctx, b.name, srcKey, b.name, dstKey)
+}
+
+// MoveObject renames srcKey to dstKey within the client's bucket: it copies
+// the object and, only on a successful copy, deletes the source.
+func (b *IHarborObjectClient) MoveObject(ctx context.Context, srcKey, dstKey string) error {
+	if err := b.CopyObject(ctx, srcKey, dstKey); err != nil {
+		return errors.Wrapf(err, "move object [%s] to [%s]", srcKey, dstKey)
+	}
+	if err := b.DeleteObject(ctx, srcKey); err != nil {
+		return errors.Wrapf(err, "delete source object [%s] after move", srcKey)
+	}
+	return nil
+}
+
+// CopyObjectAcrossBuckets copies srcKey in srcBucket to dstKey in dstBucket,
+// using iharbor's native copy endpoint when it is implemented and falling
+// back to a streaming GetObject->Upload round-trip when it returns "not
+// implemented".
+func (b *IHarborObjectClient) CopyObjectAcrossBuckets(ctx context.Context, srcBucket, srcKey, dstBucket, dstKey string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	err := b.client.CopyObject(ctx, srcBucket, srcKey, dstBucket, dstKey)
+	if err == nil {
+		return nil
+	}
+	if !b.client.IsNotImplementedErr(err) {
+		return errors.Wrapf(err, "copy object [%s/%s] to [%s/%s]", srcBucket, srcKey, dstBucket, dstKey)
+	}
+
+	return b.streamingCopy(ctx, srcBucket, srcKey, dstBucket, dstKey)
+}
+
+// streamingCopy is the fallback used when iharbor has no native copy
+// endpoint: it reads the full source object and re-uploads it through the
+// same retrying, idempotency-keyed paths putObjectData/uploadStreamToBucket
+// give PutObject/UploadStream, going through the multipart one once it
+// crosses multipartThreshold.
+func (b *IHarborObjectClient) streamingCopy(ctx context.Context, srcBucket, srcKey, dstBucket, dstKey string) error {
+	resp, _, err := b.client.GetObject(ctx, srcBucket, srcKey, 0, -1)
+	if err != nil {
+		return errors.Wrapf(err, "download source object [%s/%s] for copy", srcBucket, srcKey)
+	}
+	defer resp.Close()
+
+	data, err := ioutil.ReadAll(resp)
+	if err != nil {
+		return errors.Wrapf(err, "read source object [%s/%s] for copy", srcBucket, srcKey)
+	}
+
+	if int64(len(data)) <= multipartThreshold {
+		return b.putObjectData(ctx, dstBucket, dstKey, data)
+	}
+
+	return b.uploadStreamToBucket(ctx, dstBucket, dstKey, bytes.NewReader(data), 0)
+}
@@ -1,15 +1,20 @@
 package iharbor
 
 import (
+	"bytes"
 	"context"
 	"flag"
-	"fmt"
 	"io"
+	"io/ioutil"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/grafana/loki/pkg/storage/chunk/client"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
 	"github.com/pkg/errors"
+
+	"github.com/grafana/loki/pkg/storage/chunk/client"
 )
 
 // DirDelim is the delimiter used to model a directory structure in an object store bucket.
@@ -22,6 +27,29 @@ type IHarborConfig struct {
 	Token      string `yaml:"token"`
 	Insecure   bool   `yaml:"insecure"`
 	Debug      bool   `yaml:"debug"`
+
+	// CompactionEnabled turns on the background compactor that merges small
+	// chunk objects of each tenant/day into a larger aggregate object. The
+	// source objects are kept and reads still go to them (see compactOnce).
+	CompactionEnabled    bool          `yaml:"compaction_enabled"`
+	CompactionInterval   time.Duration `yaml:"compaction_interval"`
+	CompactionPrefix     string        `yaml:"compaction_prefix"`
+	CompactionMinObjects int           `yaml:"compaction_min_objects"`
+	CompactionMaxSize    int64         `yaml:"compaction_max_size"`
+
+	// TLS/transport tuning, wired through to NewIHarborClient via Option.
+	CAFile         string        `yaml:"tls_ca_path"`
+	ClientCertFile string        `yaml:"tls_cert_path"`
+	ClientKeyFile  string        `yaml:"tls_key_path"`
+	HTTPTimeout    time.Duration `yaml:"http_timeout"`
+	MaxIdleConns   int           `yaml:"max_idle_conns"`
+
+	UploadPartSize    int64 `yaml:"upload_part_size"`
+	UploadConcurrency int   `yaml:"upload_concurrency"`
+
+	MaxRetries int           `yaml:"max_retries"`
+	MinBackoff time.Duration `yaml:"min_backoff"`
+	MaxBackoff time.Duration `yaml:"max_backoff"`
 }
 
 // RegisterFlags adds the flags required to config this to the given FlagSet
@@ -36,6 +64,21 @@ func (cfg *IHarborConfig) RegisterFlagsWithPrefix(prefix string, f *flag.FlagSet
 	f.StringVar(&cfg.Token, prefix+"iharbor.token", "", "iharbor auth token to use.")
 	f.BoolVar(&cfg.Insecure, prefix+"iharbor.insecure", false, "Disable https on iharbor connection.")
 	f.BoolVar(&cfg.Debug, prefix+"iharbor.debug", false, "Enable debug log")
+	f.BoolVar(&cfg.CompactionEnabled, prefix+"iharbor.compaction-enabled", false, "Periodically merge small chunk objects into larger ones in the background.")
+	f.DurationVar(&cfg.CompactionInterval, prefix+"iharbor.compaction-interval", 1*time.Hour, "How often to run the compactor.")
+	f.StringVar(&cfg.CompactionPrefix, prefix+"iharbor.compaction-prefix", "", "Only list and compact objects under this prefix. Defaults to the whole bucket.")
+	f.IntVar(&cfg.CompactionMinObjects, prefix+"iharbor.compaction-min-objects", 32, "Minimum number of objects in a tenant/day group before they are compacted.")
+	f.Int64Var(&cfg.CompactionMaxSize, prefix+"iharbor.compaction-max-size", 1024*1024*256, "Maximum size, in bytes, of an object produced by the compactor.")
+	f.StringVar(&cfg.CAFile, prefix+"iharbor.tls-ca-path", "", "Path to the CA certificates file to validate the iharbor server certificate against.")
+	f.StringVar(&cfg.ClientCertFile, prefix+"iharbor.tls-cert-path", "", "Path to the client certificate file for mTLS to iharbor.")
+	f.StringVar(&cfg.ClientKeyFile, prefix+"iharbor.tls-key-path", "", "Path to the client private key file for mTLS to iharbor.")
+	f.DurationVar(&cfg.HTTPTimeout, prefix+"iharbor.http-timeout", 30*time.Second, "Timeout for HTTP requests to iharbor.")
+	f.IntVar(&cfg.MaxIdleConns, prefix+"iharbor.max-idle-conns", 100, "Maximum number of idle HTTP connections to keep open to iharbor.")
+	f.Int64Var(&cfg.UploadPartSize, prefix+"iharbor.upload-part-size", 1024*1024*64, "Size of each part used by UploadStream, which Upload uses for objects over 128MiB and for objects whose size cannot be determined ahead of time.")
+	f.IntVar(&cfg.UploadConcurrency, prefix+"iharbor.upload-concurrency", 4, "Number of parts UploadStream is allowed to upload concurrently.")
+	f.IntVar(&cfg.MaxRetries, prefix+"iharbor.max-retries", 3, "Maximum number of retries for transient iharbor errors.")
+	f.DurationVar(&cfg.MinBackoff, prefix+"iharbor.min-backoff", 100*time.Millisecond, "Minimum backoff between retries of transient iharbor errors.")
+	f.DurationVar(&cfg.MaxBackoff, prefix+"iharbor.max-backoff", 10*time.Second, "Maximum backoff between retries of transient iharbor errors.")
 }
 
 // Validate checks to see if mandatory iharbor config options are set.
@@ -58,14 +101,30 @@ type IHarborObjectClient struct {
 	name   string
 	client *IHarborClient
 	config IHarborConfig
+	logger log.Logger
+
+	compactionDone chan struct{}
+	compactionWG   sync.WaitGroup
 }
 
-// NewIHarborObjectClient returns a new IharborObjectClient using the provided IharborConfig values.
-func NewIHarborObjectClient(config IHarborConfig) (*IHarborObjectClient, error) {
+// NewIHarborObjectClient returns a new IharborObjectClient using the provided
+// IharborConfig values. Extra Option values can be passed to plug in a custom
+// *http.Client, RoundTripper, TLS config or oauth2.TokenSource; otherwise one
+// is built from the CAFile/ClientCertFile/HTTPTimeout/MaxIdleConns fields of
+// config.
+func NewIHarborObjectClient(config IHarborConfig, opts ...Option) (*IHarborObjectClient, error) {
 	if err := config.Validate(); err != nil {
 		return nil, errors.Wrap(err, "invalid iharbor Storage config")
 	}
-	client, err := NewIHarborClient(!config.Insecure, config.Endpoint, config.Token)
+
+	resolved := resolveClientOptions(opts...)
+	httpClient, err := resolved.buildHTTPClient(config)
+	if err != nil {
+		return nil, errors.Wrap(err, "build iharbor HTTP client")
+	}
+
+	client, err := NewIHarborClient(!config.Insecure, config.Endpoint, config.Token,
+		WithHTTPClient(httpClient), WithTokenSource(resolved.tokenSource))
 	if err != nil {
 		return nil, errors.Wrap(err, "create iharbor client failed")
 	}
@@ -74,56 +133,102 @@ func NewIHarborObjectClient(config IHarborConfig) (*IHarborObjectClient, error)
 		client: client,
 		name:   config.BucketName,
 		config: config,
+		logger: resolved.logger,
+	}
+
+	level.Info(bkt.logger).Log("msg", "created iharbor object client", "bucket", config.BucketName)
+
+	if config.CompactionEnabled {
+		bkt.startCompaction()
 	}
 
-	fmt.Println("success new iharbor object client")
 	return bkt, nil
 }
 
-func (b *IHarborObjectClient) Stop() {}
+func (b *IHarborObjectClient) Stop() {
+	if b.compactionDone != nil {
+		close(b.compactionDone)
+		b.compactionWG.Wait()
+	}
+}
 
 // PutObject the contents of the reader as an object into the bucket.
 func (b *IHarborObjectClient) PutObject(ctx context.Context, objectKey string, object io.ReadSeeker) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 
-	err := b.client.PutObject(b.name, objectKey, object)
+	if _, err := object.Seek(0, io.SeekStart); err != nil {
+		return errors.Wrap(err, "rewind object before retry")
+	}
+	data, err := ioutil.ReadAll(object)
 	if err != nil {
-		return errors.Wrapf(err, "failed to PutObject(PutObject) [%s]", objectKey)
+		return errors.Wrap(err, "buffer object to compute idempotency key")
 	}
 
+	return b.putObjectData(ctx, b.name, objectKey, data)
+}
+
+// putObjectData uploads data as objectKey in bucket, retrying transient
+// failures and attaching an idempotency key derived from bucket/objectKey/
+// data so a retried attempt is deduplicated server-side instead of writing a
+// duplicate part. PutObject and streamingCopy both funnel through this so
+// every whole-object write gets the same retry and idempotency handling,
+// regardless of which bucket it targets.
+func (b *IHarborObjectClient) putObjectData(ctx context.Context, bucket, objectKey string, data []byte) error {
+	err := b.withRetry(ctx, "PutObject", func() error {
+		idemCtx := withIdempotencyKey(ctx, bucket, objectKey, 0, data)
+		return b.client.PutObject(idemCtx, bucket, objectKey, bytes.NewReader(data))
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to PutObject(PutObject) [%s]", objectKey)
+	}
 	return nil
 }
 
-// Upload the contents of the reader as an object into the bucket.
+// Upload the contents of the reader as an object into the bucket. Both
+// branches go through the same retrying, idempotency-keyed paths as
+// PutObject/UploadStream: PutObject for objects that fit in a single
+// request, UploadStream for everything else, so a retried chunk write never
+// risks a duplicate part the way calling IHarborClient directly would.
 func (b *IHarborObjectClient) Upload(ctx context.Context, objectKey string, object io.ReadSeeker) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	size, err := TryToGetSize(object)
 	if err != nil {
-		return errors.Wrapf(err, "failed to get size to PutObject [%s]", objectKey)
+		// Size discovery failed, e.g. because object isn't a real seekable
+		// file: stream it through the multipart path instead of buffering.
+		return b.UploadStream(ctx, objectKey, object, b.config.UploadPartSize)
 	}
 
 	if size <= 1024*1024*128 { // 128Mb
-		err := b.client.PutObject(b.name, objectKey, object)
-		if err != nil {
-			return errors.Wrapf(err, "failed to PutObject(PutObject) [%s]", objectKey)
-		}
-	} else {
-		err := b.client.MultipartUploadObject(b.name, objectKey, object, 64)
-		if err != nil {
-			return errors.Wrapf(err, "failed to PutObject(multipart) [%s]", objectKey)
-		}
+		return b.PutObject(ctx, objectKey, object)
 	}
 
-	return nil
+	return b.UploadStream(ctx, objectKey, object, b.config.UploadPartSize)
 }
 
-func (b *IHarborObjectClient) getRange(_ context.Context, objectKey string, off, length int64) (io.ReadCloser, int64, error) {
+func (b *IHarborObjectClient) getRange(ctx context.Context, objectKey string, off, length int64) (io.ReadCloser, int64, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, 0, err
+	}
 
 	if len(objectKey) == 0 {
 		return nil, 0, errors.New("given object key should not empty")
 	}
 
-	resp, contentLength, err := b.client.GetObject(b.name, objectKey, off, length)
+	var (
+		resp          io.ReadCloser
+		contentLength int64
+	)
+	err := b.withRetry(ctx, "GetObject", func() error {
+		var err error
+		resp, contentLength, err = b.client.GetObject(ctx, b.name, objectKey, off, length)
+		return err
+	})
 	if err != nil {
-
 		return nil, 0, err
 	}
 
@@ -151,7 +256,12 @@ func (b *IHarborObjectClient) List(ctx context.Context, prefix string, delimiter
 			return nil, nil, errors.Wrap(err, "context closed while iterating bucket")
 		}
 
-		results, err := b.client.ListBucketObjects(b.name, prefix, delimiter, continuationToken, -1)
+		var results *ListBucketObjectsResult
+		err := b.withRetry(ctx, "List", func() error {
+			var err error
+			results, err = b.client.ListBucketObjects(ctx, b.name, prefix, delimiter, continuationToken, -1)
+			return err
+		})
 		if err != nil {
 			if b.client.IsNoParentPathErr(err) || b.client.IsObjNotFoundErr(err) {
 				return storageObjects, commonPrefixes, nil
@@ -186,7 +296,13 @@ func (b *IHarborObjectClient) List(ctx context.Context, prefix string, delimiter
 
 // DeleteObject removes the object with the given name.
 func (b *IHarborObjectClient) DeleteObject(ctx context.Context, objectKey string) error {
-	if err := b.client.DeleteObject(b.name, objectKey); err != nil {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	err := b.withRetry(ctx, "DeleteObject", func() error {
+		return b.client.DeleteObject(ctx, b.name, objectKey)
+	})
+	if err != nil {
 		return errors.Wrap(err, "delete iharbor object")
 	}
 	return nil
@@ -197,9 +313,19 @@ func (b *IHarborObjectClient) IsObjectNotFoundErr(err error) bool {
 	return b.client.IsObjNotFoundErr(errors.Cause(err))
 }
 
+// IsRetryableErr delegates to IHarborClient.IsRetryableErr's status-code and
+// network-error classification; see withRetry, which is the only caller.
+func (b *IHarborObjectClient) IsRetryableErr(err error) bool {
+	return b.client.IsRetryableErr(errors.Cause(err))
+}
+
 // Exists checks if the given object exists in the bucket.
 func (b *IHarborObjectClient) Exists(ctx context.Context, objectKey string) (bool, error) {
-	meta, err := b.client.GetObjectMeta(b.name, objectKey)
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	meta, err := b.client.GetObjectMeta(ctx, b.name, objectKey)
 	if err != nil {
 		if b.client.IsObjNotFoundErr(err) {
 			return false, nil
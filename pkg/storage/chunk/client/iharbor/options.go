@@ -0,0 +1,130 @@
+package iharbor
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/go-kit/log"
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+)
+
+// clientOptions holds the transport and object-client settings that can be
+// customized via Option when constructing an IHarborObjectClient.
+type clientOptions struct {
+	httpClient  *http.Client
+	tokenSource oauth2.TokenSource
+	tlsConfig   *tls.Config
+	transport   http.RoundTripper
+	logger      log.Logger
+}
+
+// Option customizes the HTTP client used by NewIHarborClient, mirroring the
+// option.ClientOption pattern used by google-cloud-go.
+type Option func(*clientOptions)
+
+// WithHTTPClient overrides the *http.Client used for every request. It takes
+// precedence over WithTransport and WithTLSConfig.
+func WithHTTPClient(c *http.Client) Option {
+	return func(o *clientOptions) { o.httpClient = c }
+}
+
+// WithTokenSource refreshes the auth token from ts instead of using the
+// static IHarborConfig.Token for every request.
+func WithTokenSource(ts oauth2.TokenSource) Option {
+	return func(o *clientOptions) { o.tokenSource = ts }
+}
+
+// WithTLSConfig sets the TLS configuration used when dialing the iharbor
+// endpoint, enabling mTLS or custom CA pools.
+func WithTLSConfig(c *tls.Config) Option {
+	return func(o *clientOptions) { o.tlsConfig = c }
+}
+
+// WithTransport overrides the http.RoundTripper used by the client, e.g. to
+// add tracing or retry middleware.
+func WithTransport(rt http.RoundTripper) Option {
+	return func(o *clientOptions) { o.transport = rt }
+}
+
+// WithLogger sets the logger the IHarborObjectClient reports background
+// errors to, e.g. failures from the compactor goroutine. Defaults to a
+// no-op logger.
+func WithLogger(logger log.Logger) Option {
+	return func(o *clientOptions) { o.logger = logger }
+}
+
+func resolveClientOptions(opts ...Option) *clientOptions {
+	o := &clientOptions{logger: log.NewNopLogger()}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// buildHTTPClient turns the resolved options into a single *http.Client,
+// falling back to sane defaults derived from cfg when no explicit
+// WithHTTPClient was given.
+func (o *clientOptions) buildHTTPClient(cfg IHarborConfig) (*http.Client, error) {
+	if o.httpClient != nil {
+		return o.httpClient, nil
+	}
+
+	transport := o.transport
+	if transport == nil {
+		tlsConfig := o.tlsConfig
+		if tlsConfig == nil {
+			var err error
+			tlsConfig, err = tlsConfigFromFiles(cfg)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		transport = &http.Transport{
+			TLSClientConfig:     tlsConfig,
+			MaxIdleConns:        cfg.MaxIdleConns,
+			MaxIdleConnsPerHost: cfg.MaxIdleConns,
+		}
+	}
+
+	return &http.Client{
+		Transport: transport,
+		Timeout:   cfg.HTTPTimeout,
+	}, nil
+}
+
+// tlsConfigFromFiles builds a *tls.Config from the CA bundle and client
+// cert/key paths in cfg, returning nil (use Go's default trust store) if
+// none were configured.
+func tlsConfigFromFiles(cfg IHarborConfig) (*tls.Config, error) {
+	if cfg.CAFile == "" && cfg.ClientCertFile == "" {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{}
+
+	if cfg.CAFile != "" {
+		caCert, err := ioutil.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "read iharbor CA bundle")
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caCert) {
+			return nil, errors.New("iharbor CA bundle contains no usable certificates")
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if cfg.ClientCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.ClientCertFile, cfg.ClientKeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "load iharbor client certificate")
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
@@ -0,0 +1,103 @@
+package iharbor
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var retriesHistogram = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "loki_iharbor_request_retries",
+	Help:    "Number of retries per iharbor operation before it either succeeded or ran out of attempts.",
+	Buckets: []float64{0, 1, 2, 3, 5, 8},
+}, []string{"operation"})
+
+// idempotencyKeyHeader is set on every retried PutObject/UploadPart request
+// so that iharbor can de-duplicate a part that was actually written by a
+// prior attempt whose response never reached us.
+const idempotencyKeyHeader = "X-Idempotency-Key"
+
+type idempotencyKeyCtxKey struct{}
+
+// withIdempotencyKey attaches a stable key, derived from the object
+// identity and contents being written, to ctx. IHarborClient reads it off
+// the context to set idempotencyKeyHeader on the underlying HTTP request.
+func withIdempotencyKey(ctx context.Context, bucket, key string, partNumber int, data []byte) context.Context {
+	return context.WithValue(ctx, idempotencyKeyCtxKey{}, idempotencyKey(bucket, key, partNumber, data))
+}
+
+// idempotencyKeyFromContext returns the key withIdempotencyKey attached to
+// ctx, if any.
+func idempotencyKeyFromContext(ctx context.Context) (string, bool) {
+	v, ok := ctx.Value(idempotencyKeyCtxKey{}).(string)
+	return v, ok
+}
+
+func idempotencyKey(bucket, key string, partNumber int, data []byte) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s/%s/%d/", bucket, key, partNumber)
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// withRetry runs fn, retrying with jittered exponential backoff as long as
+// fn's error is classified retryable by IsRetryableErr and the configured
+// MaxRetries has not been exhausted. The number of retries spent is
+// recorded against operation in retriesHistogram.
+func (b *IHarborObjectClient) withRetry(ctx context.Context, operation string, fn func() error) error {
+	var (
+		err     error
+		retries int
+	)
+
+	backoff := b.config.MinBackoff
+	if backoff <= 0 {
+		backoff = 100 * time.Millisecond
+	}
+	maxBackoff := b.config.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = 10 * time.Second
+	}
+
+	for attempt := 0; attempt <= b.config.MaxRetries; attempt++ {
+		err = fn()
+		if err == nil {
+			break
+		}
+		if attempt == b.config.MaxRetries || !b.IsRetryableErr(err) {
+			break
+		}
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			err = ctxErr
+			break
+		}
+
+		retries++
+		sleep := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2+1)))
+		timer := time.NewTimer(sleep)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			err = ctx.Err()
+			retries--
+		case <-timer.C:
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+
+	retriesHistogram.WithLabelValues(operation).Observe(float64(retries))
+	return err
+}
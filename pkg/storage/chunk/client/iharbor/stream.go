@@ -0,0 +1,170 @@
+package iharbor
+
+import (
+	"context"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// uploadPart is one part accepted by the multipart upload session, returned
+// by the worker that uploaded it so CompleteMultipartUpload can assemble
+// them back in order.
+type uploadPart struct {
+	number int
+	etag   string
+}
+
+// UploadStream uploads the contents of r as objectKey in the client's own
+// bucket using the multipart path unconditionally, so callers do not need
+// an io.ReadSeeker of known size.
+func (b *IHarborObjectClient) UploadStream(ctx context.Context, objectKey string, r io.Reader, partSize int64) error {
+	return b.uploadStreamToBucket(ctx, b.name, objectKey, r, partSize)
+}
+
+// uploadStreamToBucket is UploadStream's implementation, parameterized by
+// destination bucket so streamingCopy (copy.go) can reuse the same
+// retrying, idempotency-keyed multipart path for a copy that crosses
+// buckets. It reads up to partSize bytes at a time, initiates the
+// multipart session on the first non-empty read, uploads parts concurrently
+// with a worker pool bounded by config.UploadConcurrency, and completes or
+// aborts the session depending on whether every part succeeded.
+func (b *IHarborObjectClient) uploadStreamToBucket(ctx context.Context, bucket, objectKey string, r io.Reader, partSize int64) error {
+	partSize = partSizeOrDefault(partSize)
+
+	var (
+		uploadID  string
+		partNum   int
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		parts     []uploadPart
+		firstErr  error
+		semaphore = make(chan struct{}, concurrencyOrDefault(b.config.UploadConcurrency))
+	)
+
+	recordErr := func(err error) {
+		mu.Lock()
+		if firstErr == nil {
+			firstErr = err
+		}
+		mu.Unlock()
+	}
+	loadErr := func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		return firstErr
+	}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			recordErr(err)
+			break
+		}
+		if loadErr() != nil {
+			break
+		}
+
+		buf := make([]byte, partSize)
+		n, readErr := io.ReadFull(r, buf)
+		if n == 0 && readErr != nil {
+			if readErr != io.EOF && readErr != io.ErrUnexpectedEOF {
+				recordErr(errors.Wrap(readErr, "read part for upload stream"))
+			}
+			break
+		}
+		buf = buf[:n]
+
+		if uploadID == "" {
+			id, err := b.client.InitiateMultipartUpload(ctx, bucket, objectKey)
+			if err != nil {
+				recordErr(errors.Wrapf(err, "initiate multipart upload [%s]", objectKey))
+				break
+			}
+			uploadID = id
+		}
+
+		partNum++
+		num := partNum
+		data := buf
+
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+
+			var etag string
+			err := b.withRetry(ctx, "UploadPart", func() error {
+				idemCtx := withIdempotencyKey(ctx, bucket, objectKey, num, data)
+				var err error
+				etag, err = b.client.UploadPart(idemCtx, bucket, objectKey, uploadID, num, data)
+				return err
+			})
+			if err != nil {
+				recordErr(errors.Wrapf(err, "upload part %d of [%s]", num, objectKey))
+				return
+			}
+
+			mu.Lock()
+			parts = append(parts, uploadPart{number: num, etag: etag})
+			mu.Unlock()
+		}()
+
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+	}
+
+	wg.Wait()
+
+	if uploadID == "" {
+		// Nothing was ever read: upload an empty object for consistency
+		// with PutObject/Upload on a zero-length reader.
+		if firstErr != nil {
+			return firstErr
+		}
+		return b.putObjectData(ctx, bucket, objectKey, nil)
+	}
+
+	if firstErr != nil {
+		if abortErr := b.client.AbortMultipartUpload(ctx, bucket, objectKey, uploadID); abortErr != nil {
+			return errors.Wrapf(firstErr, "upload stream failed and abort also failed: %v", abortErr)
+		}
+		return errors.Wrapf(firstErr, "upload stream [%s]", objectKey)
+	}
+
+	if err := b.client.CompleteMultipartUpload(ctx, bucket, objectKey, uploadID, completeParts(parts)); err != nil {
+		return errors.Wrapf(err, "complete multipart upload [%s]", objectKey)
+	}
+
+	return nil
+}
+
+func concurrencyOrDefault(n int) int {
+	if n <= 0 {
+		return 4
+	}
+	return n
+}
+
+// partSizeOrDefault floors n at a sane part size. Upload() passes
+// b.config.UploadPartSize straight through, which is 0 for any IHarborConfig
+// built without going through RegisterFlags; without this floor,
+// io.ReadFull(r, buf) on a zero-length buf returns (0, nil) immediately, so
+// the read loop's n == 0 && readErr != nil exit condition never fires and
+// UploadStream spins forever issuing zero-byte parts.
+func partSizeOrDefault(n int64) int64 {
+	if n <= 0 {
+		return 1024 * 1024 * 64
+	}
+	return n
+}
+
+// completeParts sorts parts back into upload order, since they may have
+// finished uploading out of order under the worker pool.
+func completeParts(parts []uploadPart) []uploadPart {
+	sort.Slice(parts, func(i, j int) bool { return parts[i].number < parts[j].number })
+	return parts
+}